@@ -0,0 +1,43 @@
+// Package log is the adapter's logging sink. Call sites log
+// alternating key/value pairs (e.g. log.Error("msg", "failed to
+// connect", "err", err)) against a package-level default; see Logger
+// for pluggable, per-Config logging that embedders can route elsewhere.
+package log
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var std = log.New(os.Stderr, "", log.LstdFlags)
+
+// Debug logs keyvals at debug level.
+func Debug(keyvals ...interface{}) {
+	logKeyvals("debug", keyvals...)
+}
+
+// Info logs keyvals at info level.
+func Info(keyvals ...interface{}) {
+	logKeyvals("info", keyvals...)
+}
+
+// Warn logs keyvals at warn level.
+func Warn(keyvals ...interface{}) {
+	logKeyvals("warn", keyvals...)
+}
+
+// Error logs keyvals at error level.
+func Error(keyvals ...interface{}) {
+	logKeyvals("error", keyvals...)
+}
+
+func logKeyvals(level string, keyvals ...interface{}) {
+	pairs := make([]string, 0, len(keyvals)/2+1)
+	pairs = append(pairs, "level="+level)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", keyvals[i], keyvals[i+1]))
+	}
+	std.Println(strings.Join(pairs, " "))
+}
@@ -0,0 +1,76 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Logger is a structured, leveled logging interface. Setting it on
+// pgprometheus.Config lets an embedder route the adapter's log output
+// into its own observability pipeline instead of this package's global
+// sink.
+type Logger interface {
+	Debug(msg string, kv ...any)
+	Info(msg string, kv ...any)
+	Warn(msg string, kv ...any)
+	Error(msg string, kv ...any)
+}
+
+// Default is the Logger used when Config.Logger is left nil. It
+// forwards to this package's global Debug/Info/Warn/Error functions.
+var Default Logger = defaultLogger{}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Debug(msg string, kv ...any) { Debug(prepend(msg, kv)...) }
+func (defaultLogger) Info(msg string, kv ...any)  { Info(prepend(msg, kv)...) }
+func (defaultLogger) Warn(msg string, kv ...any)  { Warn(prepend(msg, kv)...) }
+func (defaultLogger) Error(msg string, kv ...any) { Error(prepend(msg, kv)...) }
+
+func prepend(msg string, kv []any) []interface{} {
+	return append([]interface{}{"msg", msg}, kv...)
+}
+
+// NopLogger discards everything. Useful in tests that don't want to
+// assert on or pollute test output with log lines.
+type NopLogger struct{}
+
+func (NopLogger) Debug(string, ...any) {}
+func (NopLogger) Info(string, ...any)  {}
+func (NopLogger) Warn(string, ...any)  {}
+func (NopLogger) Error(string, ...any) {}
+
+// SlogLogger adapts a *slog.Logger to Logger, mapping this package's
+// key/value calling convention onto slog.Logger.LogAttrs.
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger wraps logger as a Logger.
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	return &SlogLogger{logger: logger}
+}
+
+func (s *SlogLogger) Debug(msg string, kv ...any) { s.log(slog.LevelDebug, msg, kv...) }
+func (s *SlogLogger) Info(msg string, kv ...any)  { s.log(slog.LevelInfo, msg, kv...) }
+func (s *SlogLogger) Warn(msg string, kv ...any)  { s.log(slog.LevelWarn, msg, kv...) }
+func (s *SlogLogger) Error(msg string, kv ...any) { s.log(slog.LevelError, msg, kv...) }
+
+func (s *SlogLogger) log(level slog.Level, msg string, kv ...any) {
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprintf("%v", kv[i])
+		}
+		attrs = append(attrs, slog.Any(key, kv[i+1]))
+	}
+
+	s.logger.LogAttrs(ctx, level, msg, attrs...)
+}
@@ -1,6 +1,7 @@
 package pgprometheus
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"flag"
@@ -17,6 +18,7 @@ import (
 
 	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 )
@@ -40,6 +42,22 @@ type Config struct {
 	useTimescaleDb            bool
 	dbConnectRetries          int
 	readOnly                  bool
+	labelCacheSize            int
+	pgPingCron                string
+	pgPingTimeout             time.Duration
+	txIsolation               sql.IsolationLevel
+
+	// Registerer is the prometheus.Registerer used to register the
+	// client's own collectors (connection pool and write/read-path
+	// metrics). It is not settable via flags since it's meant for
+	// programmatic embedders; if nil, prometheus.DefaultRegisterer is
+	// used.
+	Registerer prometheus.Registerer
+
+	// Logger is used for the client's log output. It is not settable
+	// via flags since it's meant for programmatic embedders; if nil,
+	// log.Default is used.
+	Logger log.Logger
 }
 
 // ParseFlags parses the configuration flags specific to PostgreSQL and TimescaleDB
@@ -61,20 +79,72 @@ func ParseFlags(cfg *Config) *Config {
 	flag.BoolVar(&cfg.useTimescaleDb, "pg-use-timescaledb", true, "Use timescaleDB")
 	flag.IntVar(&cfg.dbConnectRetries, "pg-db-connect-retries", 0, "How many times to retry connecting to the database")
 	flag.BoolVar(&cfg.readOnly, "pg-read-only", false, "Read-only mode. Don't write to database. Useful when pointing adapter to read replica")
+	flag.IntVar(&cfg.labelCacheSize, "pg-label-cache-size", 100000, "Max number of label sets to keep in the in-process label-ID cache. 0 disables the cache")
+	flag.StringVar(&cfg.pgPingCron, "pg-ping-cron", "@every 30s", "Cron spec for the background DB health-ping schedule")
+	flag.DurationVar(&cfg.pgPingTimeout, "pg-ping-timeout", time.Second*5, "Timeout for each background DB health ping")
+	flag.Var(txIsolationFlag{&cfg.txIsolation}, "pg-tx-isolation", "Transaction isolation level for Client.Write (default, read-uncommitted, read-committed, repeatable-read, serializable)")
 	return cfg
 }
 
+// txIsolationLevels maps the -pg-tx-isolation flag's accepted names to
+// the sql.IsolationLevel values database/sql understands.
+var txIsolationLevels = map[string]sql.IsolationLevel{
+	"default":          sql.LevelDefault,
+	"read-uncommitted": sql.LevelReadUncommitted,
+	"read-committed":   sql.LevelReadCommitted,
+	"repeatable-read":  sql.LevelRepeatableRead,
+	"serializable":     sql.LevelSerializable,
+}
+
+// txIsolationFlag adapts sql.IsolationLevel to flag.Value so it can be
+// set directly from a named isolation level on the command line.
+type txIsolationFlag struct {
+	level *sql.IsolationLevel
+}
+
+func (f txIsolationFlag) String() string {
+	if f.level == nil {
+		return sql.LevelDefault.String()
+	}
+	return f.level.String()
+}
+
+func (f txIsolationFlag) Set(s string) error {
+	level, ok := txIsolationLevels[strings.ToLower(s)]
+	if !ok {
+		return fmt.Errorf("unknown transaction isolation level %q", s)
+	}
+	*f.level = level
+	return nil
+}
+
 // Client sends Prometheus samples to PostgreSQL
 type Client struct {
-	DB  *sql.DB
-	cfg *Config
+	DB         *sql.DB
+	cfg        *Config
+	logger     log.Logger
+	labelCache *labelCache
+
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
+
+	writeDuration     prometheus.Histogram
+	copyRows          prometheus.Counter
+	labelRowsInserted prometheus.Counter
+	readDuration      prometheus.Histogram
+	errorsByPhase     *prometheus.CounterVec
+	dbStats           prometheus.Collector
+
+	pinger *pingProber
 }
 
 const (
-	sqlCreateTmpTable = "CREATE TEMPORARY TABLE IF NOT EXISTS %s_tmp(sample prom_sample) ON COMMIT DELETE ROWS;"
-	sqlCopyTable      = "COPY \"%s\" FROM STDIN"
-	sqlInsertLabels   = "INSERT INTO %s_labels (metric_name, labels) SELECT tmp.prom_name, tmp.prom_labels FROM (SELECT prom_time(sample), prom_value(sample), prom_name(sample), prom_labels(sample) FROM %s_tmp) tmp LEFT JOIN %s_labels l ON tmp.prom_name=l.metric_name AND tmp.prom_labels=l.labels WHERE l.metric_name IS NULL ON CONFLICT (metric_name, labels) DO NOTHING;"
-	sqlInsertValues   = "INSERT INTO %s_values SELECT tmp.prom_time, tmp.prom_value, l.id FROM (SELECT prom_time(sample), prom_value(sample), prom_name(sample), prom_labels(sample) FROM %s_tmp) tmp INNER JOIN %s_labels l on tmp.prom_name=l.metric_name AND  tmp.prom_labels=l.labels;"
+	sqlCreateTmpTable  = "CREATE TEMPORARY TABLE IF NOT EXISTS %s_tmp(sample prom_sample) ON COMMIT DELETE ROWS;"
+	sqlCopyTable       = "COPY \"%s\" FROM STDIN"
+	sqlCopyValuesTable = "COPY \"%s_values\" (time, value, labels_id) FROM STDIN"
+	sqlInsertLabels    = "INSERT INTO %s_labels (metric_name, labels) SELECT tmp.prom_name, tmp.prom_labels FROM (SELECT prom_time(sample), prom_value(sample), prom_name(sample), prom_labels(sample) FROM %s_tmp) tmp LEFT JOIN %s_labels l ON tmp.prom_name=l.metric_name AND tmp.prom_labels=l.labels WHERE l.metric_name IS NULL ON CONFLICT (metric_name, labels) DO NOTHING RETURNING id, metric_name, labels;"
+	sqlInsertValues    = "INSERT INTO %s_values SELECT tmp.prom_time, tmp.prom_value, l.id FROM (SELECT prom_time(sample), prom_value(sample), prom_name(sample), prom_labels(sample) FROM %s_tmp) tmp INNER JOIN %s_labels l on tmp.prom_name=l.metric_name AND  tmp.prom_labels=l.labels;"
+	sqlSelectLabels    = "SELECT id, metric_name, labels FROM %s_labels"
 )
 
 var (
@@ -83,6 +153,11 @@ var (
 
 // NewClient creates a new PostgreSQL client
 func NewClient(cfg *Config) *Client {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.Default
+	}
+
 	connStr := fmt.Sprintf("host=%v port=%v user=%v dbname=%v password='%v' sslmode=%v connect_timeout=10",
 		cfg.host, cfg.port, cfg.user, cfg.database, cfg.password, cfg.sslMode)
 
@@ -90,10 +165,10 @@ func NewClient(cfg *Config) *Client {
 		return sql.Open("postgres", connStr)
 	})
 
-	log.Info("msg", regexp.MustCompile("password='(.+?)'").ReplaceAllLiteralString(connStr, "password='****'"))
+	logger.Info(regexp.MustCompile("password='(.+?)'").ReplaceAllLiteralString(connStr, "password='****'"))
 
 	if err != nil {
-		log.Error("err", err)
+		logger.Error("Error connecting to database", "err", err)
 		os.Exit(1)
 	}
 
@@ -103,30 +178,140 @@ func NewClient(cfg *Config) *Client {
 	db.SetMaxIdleConns(cfg.maxIdleConns)
 
 	client := &Client{
-		DB:  db,
-		cfg: cfg,
+		DB:         db,
+		cfg:        cfg,
+		logger:     logger,
+		labelCache: newLabelCache(cfg.labelCacheSize),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "adapter",
+			Subsystem: "postgresql",
+			Name:      "label_cache_hits_total",
+			Help:      "Total number of samples whose label set was already present in the in-process label-ID cache.",
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "adapter",
+			Subsystem: "postgresql",
+			Name:      "label_cache_misses_total",
+			Help:      "Total number of samples whose label set was not found in the in-process label-ID cache.",
+		}),
+		writeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "adapter",
+			Subsystem: "postgresql",
+			Name:      "write_duration_seconds",
+			Help:      "Duration of a single Client.Write batch, from Begin to Commit.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		copyRows: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "adapter",
+			Subsystem: "postgresql",
+			Name:      "copy_rows_total",
+			Help:      "Total number of rows COPY'd into the database by Client.Write.",
+		}),
+		labelRowsInserted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "adapter",
+			Subsystem: "postgresql",
+			Name:      "label_rows_inserted_total",
+			Help:      "Total number of new rows inserted into <table>_labels.",
+		}),
+		readDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "adapter",
+			Subsystem: "postgresql",
+			Name:      "read_duration_seconds",
+			Help:      "Duration of a Client.Read call, across all queries in the request.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		errorsByPhase: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "adapter",
+			Subsystem: "postgresql",
+			Name:      "errors_total",
+			Help:      "Total number of errors encountered, partitioned by the phase in which they occurred.",
+		}, []string{"phase"}),
+		dbStats: collectors.NewDBStatsCollector(db, cfg.database),
+	}
+
+	pinger, err := newPingProber(db, cfg.pgPingCron, cfg.pgPingTimeout, logger)
+	if err != nil {
+		logger.Error("Error parsing pg-ping-cron, health probing disabled", "err", err)
+	} else {
+		pinger.start()
+	}
+	client.pinger = pinger
+
+	registerer := cfg.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	if err := registerer.Register(client); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			logger.Error("Error registering PostgreSQL client collectors", "err", err)
+		}
 	}
 
 	if !cfg.readOnly {
 		err = client.setupPgPrometheus()
 
 		if err != nil {
-			log.Error("err", err)
+			logger.Error("Error setting up pg_prometheus", "err", err)
 			os.Exit(1)
 		}
 
 		createTmpTableStmt, err = db.Prepare(fmt.Sprintf(sqlCreateTmpTable, cfg.table))
 		if err != nil {
-			log.Error("msg", "Error on preparing create tmp table statement", "err", err)
+			logger.Error("Error on preparing create tmp table statement", "err", err)
 			os.Exit(1)
 		}
+
+		if err := client.warmLabelCache(); err != nil {
+			logger.Error("Error warming label cache", "err", err)
+		}
 	} else {
-		log.Info("msg", "Running in read-only mode. Skipping schema/extension setup (should already be present)")
+		logger.Info("Running in read-only mode. Skipping schema/extension setup (should already be present)")
 	}
 
 	return client
 }
 
+// warmLabelCache preloads the label-ID cache from <table>_labels so the
+// first batches of a fresh process can still skip the labels-insert
+// round trip for series the database already knows about.
+func (c *Client) warmLabelCache() error {
+	if c.cfg.labelCacheSize <= 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf(sqlSelectLabels, c.cfg.table)
+	if c.cfg.labelCacheSize > 0 {
+		query = fmt.Sprintf("%s LIMIT %d", query, c.cfg.labelCacheSize)
+	}
+
+	rows, err := c.DB.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var loaded int
+	for rows.Next() {
+		var (
+			id         int64
+			metricName string
+			labels     sampleLabels
+		)
+		if err := rows.Scan(&id, &metricName, &labels); err != nil {
+			return err
+		}
+		c.labelCache.Add(labelFingerprint(metricName, labels.Map), id)
+		loaded++
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.logger.Info("Warmed label cache", "entries", loaded)
+	return nil
+}
+
 func (c *Client) setupPgPrometheus() error {
 	tx, err := c.DB.Begin()
 
@@ -146,7 +331,7 @@ func (c *Client) setupPgPrometheus() error {
 		_, err = tx.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb CASCADE")
 	}
 	if err != nil {
-		log.Info("msg", "Could not enable TimescaleDB extension", "err", err)
+		c.logger.Info("Could not enable TimescaleDB extension", "err", err)
 	}
 
 	var rows *sql.Rows
@@ -167,7 +352,7 @@ func (c *Client) setupPgPrometheus() error {
 		return err
 	}
 
-	log.Info("msg", "Initialized pg_prometheus extension")
+	c.logger.Info("Initialized pg_prometheus extension")
 
 	return nil
 }
@@ -178,36 +363,49 @@ func (c *Client) ReadOnly() bool {
 
 func metricString(m model.Metric) string {
 	metricName, hasName := m[model.MetricNameLabel]
-	numLabels := len(m) - 1
-	if !hasName {
-		numLabels = len(m)
-	}
-	labelStrings := make([]string, 0, numLabels)
+	labels := make(map[string]string, len(m))
 	for label, value := range m {
 		if label != model.MetricNameLabel {
-			labelStrings = append(labelStrings, fmt.Sprintf("%s=%q", label, value))
+			labels[string(label)] = string(value)
 		}
 	}
 
-	switch numLabels {
-	case 0:
-		if hasName {
-			return string(metricName)
+	name := ""
+	if hasName {
+		name = string(metricName)
+	}
+	return labelFingerprint(name, labels)
+}
+
+// labelFingerprint renders a canonical "name{k=\"v\",...}" string for a
+// metric name plus label set. It is used both as the display form of a
+// prom_sample line and as the labelCache key, so callers working from a
+// model.Metric (new samples) and callers working from a decoded labels
+// JSONB column (label-table rows) agree on the same key.
+func labelFingerprint(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		if name == "" {
+			return "{}"
 		}
-		return "{}"
-	default:
-		sort.Strings(labelStrings)
-		return fmt.Sprintf("%s{%s}", metricName, strings.Join(labelStrings, ","))
+		return name
+	}
+
+	labelStrings := make([]string, 0, len(labels))
+	for label, value := range labels {
+		labelStrings = append(labelStrings, fmt.Sprintf("%s=%q", label, value))
 	}
+	sort.Strings(labelStrings)
+	return fmt.Sprintf("%s{%s}", name, strings.Join(labelStrings, ","))
 }
 
 // Write implements the Writer interface and writes metric samples to the database
 func (c *Client) Write(samples model.Samples) error {
 	begin := time.Now()
-	tx, err := c.DB.Begin()
+	tx, err := c.DB.BeginTx(context.Background(), &sql.TxOptions{Isolation: c.cfg.txIsolation})
 
 	if err != nil {
-		log.Error("msg", "Error on Begin when writing samples", "err", err)
+		c.errorsByPhase.WithLabelValues("begin").Inc()
+		c.logger.Error("Error on Begin when writing samples", "err", err)
 		return err
 	}
 
@@ -215,7 +413,8 @@ func (c *Client) Write(samples model.Samples) error {
 
 	_, err = tx.Stmt(createTmpTableStmt).Exec()
 	if err != nil {
-		log.Error("msg", "Error executing create tmp table", "err", err)
+		c.errorsByPhase.WithLabelValues("copy").Inc()
+		c.logger.Error("Error executing create tmp table", "err", err)
 		return err
 	}
 
@@ -227,14 +426,39 @@ func (c *Client) Write(samples model.Samples) error {
 	} else {
 		copyTable = fmt.Sprintf("%s_samples", c.cfg.table)
 	}
+	normalizedWrite := copyTable == fmt.Sprintf("%s_tmp", c.cfg.table)
+
+	// When writing through the normalized schema, split off samples whose
+	// label set is already cached: those can be COPY'd straight into
+	// <table>_values by labels_id, skipping the labels-insert join below.
+	newSamples := samples
+	var cachedSamples []model.Sample
+	var cachedIDs []int64
+	if normalizedWrite && c.cfg.labelCacheSize > 0 {
+		newSamples = make(model.Samples, 0, len(samples))
+		cachedSamples = make([]model.Sample, 0, len(samples))
+		cachedIDs = make([]int64, 0, len(samples))
+		for _, sample := range samples {
+			if id, ok := c.labelCache.Get(metricString(sample.Metric)); ok {
+				cachedSamples = append(cachedSamples, *sample)
+				cachedIDs = append(cachedIDs, id)
+			} else {
+				newSamples = append(newSamples, sample)
+			}
+		}
+		c.cacheHits.Add(float64(len(cachedSamples)))
+		c.cacheMisses.Add(float64(len(newSamples)))
+	}
+
 	copyStmt, err := tx.Prepare(fmt.Sprintf(sqlCopyTable, copyTable))
 
 	if err != nil {
-		log.Error("msg", "Error on COPY prepare", "err", err)
+		c.errorsByPhase.WithLabelValues("copy").Inc()
+		c.logger.Error("Error on COPY prepare", "err", err)
 		return err
 	}
 
-	for _, sample := range samples {
+	for _, sample := range newSamples {
 		milliseconds := sample.Timestamp.UnixNano() / 1000000
 		line := fmt.Sprintf("%v %v %v", metricString(sample.Metric), sample.Value, milliseconds)
 
@@ -244,73 +468,147 @@ func (c *Client) Write(samples model.Samples) error {
 
 		_, err = copyStmt.Exec(line)
 		if err != nil {
-			log.Error("msg", "Error executing COPY statement", "stmt", line, "err", err)
+			c.errorsByPhase.WithLabelValues("copy").Inc()
+			c.logger.Error("Error executing COPY statement", "stmt", line, "err", err)
 			return err
 		}
 	}
 
 	_, err = copyStmt.Exec()
 	if err != nil {
-		log.Error("msg", "Error executing COPY statement", "err", err)
+		c.errorsByPhase.WithLabelValues("copy").Inc()
+		c.logger.Error("Error executing COPY statement", "err", err)
 		return err
 	}
+	c.copyRows.Add(float64(len(newSamples)))
 
-	if copyTable == fmt.Sprintf("%s_tmp", c.cfg.table) {
+	if len(cachedSamples) > 0 {
+		if err := c.copyCachedValues(tx, cachedSamples, cachedIDs); err != nil {
+			return err
+		}
+		c.copyRows.Add(float64(len(cachedSamples)))
+	}
+
+	if normalizedWrite {
 		stmtLabels, err := tx.Prepare(fmt.Sprintf(sqlInsertLabels, c.cfg.table, c.cfg.table, c.cfg.table))
 		if err != nil {
-			log.Error("msg", "Error on preparing labels statement", "err", err)
+			c.errorsByPhase.WithLabelValues("insert_labels").Inc()
+			c.logger.Error("Error on preparing labels statement", "err", err)
 			return err
 		}
-		_, err = stmtLabels.Exec()
+
+		rows, err := stmtLabels.Query()
 		if err != nil {
-			log.Error("msg", "Error executing labels statement", "err", err)
+			c.errorsByPhase.WithLabelValues("insert_labels").Inc()
+			c.logger.Error("Error executing labels statement", "err", err)
 			return err
 		}
+		var labelRowsInserted int
+		for rows.Next() {
+			var (
+				id         int64
+				metricName string
+				labels     sampleLabels
+			)
+			if err := rows.Scan(&id, &metricName, &labels); err != nil {
+				rows.Close()
+				c.errorsByPhase.WithLabelValues("scan").Inc()
+				c.logger.Error("Error scanning inserted label row", "err", err)
+				return err
+			}
+			if c.cfg.labelCacheSize > 0 {
+				c.labelCache.Add(labelFingerprint(metricName, labels.Map), id)
+			}
+			labelRowsInserted++
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			c.errorsByPhase.WithLabelValues("insert_labels").Inc()
+			c.logger.Error("Error iterating inserted label rows", "err", err)
+			return err
+		}
+		rows.Close()
+		c.labelRowsInserted.Add(float64(labelRowsInserted))
 
 		stmtValues, err := tx.Prepare(fmt.Sprintf(sqlInsertValues, c.cfg.table, c.cfg.table, c.cfg.table))
 		if err != nil {
-			log.Error("msg", "Error on preparing values statement", "err", err)
+			c.errorsByPhase.WithLabelValues("insert_values").Inc()
+			c.logger.Error("Error on preparing values statement", "err", err)
 			return err
 		}
 		_, err = stmtValues.Exec()
 		if err != nil {
-			log.Error("msg", "Error executing values statement", "err", err)
+			c.errorsByPhase.WithLabelValues("insert_values").Inc()
+			c.logger.Error("Error executing values statement", "err", err)
 			return err
 		}
 
 		err = stmtLabels.Close()
 		if err != nil {
-			log.Error("msg", "Error on closing labels statement", "err", err)
+			c.logger.Error("Error on closing labels statement", "err", err)
 			return err
 		}
 
 		err = stmtValues.Close()
 		if err != nil {
-			log.Error("msg", "Error on closing values statement", "err", err)
+			c.logger.Error("Error on closing values statement", "err", err)
 			return err
 		}
 	}
 
 	err = copyStmt.Close()
 	if err != nil {
-		log.Error("msg", "Error on COPY Close when writing samples", "err", err)
+		c.errorsByPhase.WithLabelValues("copy").Inc()
+		c.logger.Error("Error on COPY Close when writing samples", "err", err)
 		return err
 	}
 
 	err = tx.Commit()
 
 	if err != nil {
-		log.Error("msg", "Error on Commit when writing samples", "err", err)
+		c.errorsByPhase.WithLabelValues("commit").Inc()
+		c.logger.Error("Error on Commit when writing samples", "err", err)
 		return err
 	}
 
 	duration := time.Since(begin).Seconds()
+	c.writeDuration.Observe(duration)
 
-	log.Debug("msg", "Wrote samples", "count", len(samples), "duration", duration)
+	c.logger.Debug("Wrote samples", "count", len(samples), "duration", duration)
 
 	return nil
 }
 
+// copyCachedValues COPYs samples whose labels_id is already known
+// straight into <table>_values, bypassing the labels-insert join that
+// the tmp-table path needs for samples seen for the first time.
+func (c *Client) copyCachedValues(tx *sql.Tx, samples []model.Sample, ids []int64) error {
+	stmt, err := tx.Prepare(fmt.Sprintf(sqlCopyValuesTable, c.cfg.table))
+	if err != nil {
+		c.errorsByPhase.WithLabelValues("copy").Inc()
+		c.logger.Error("Error on cached-values COPY prepare", "err", err)
+		return err
+	}
+
+	for i, sample := range samples {
+		_, err = stmt.Exec(sample.Timestamp.Time().UTC(), float64(sample.Value), ids[i])
+		if err != nil {
+			c.errorsByPhase.WithLabelValues("copy").Inc()
+			c.logger.Error("Error executing cached-values COPY statement", "err", err)
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		c.errorsByPhase.WithLabelValues("copy").Inc()
+		c.logger.Error("Error finalizing cached-values COPY statement", "err", err)
+		return err
+	}
+
+	return stmt.Close()
+}
+
 type sampleLabels struct {
 	JSON        []byte
 	Map         map[string]string
@@ -327,9 +625,13 @@ func createOrderedKeys(m *map[string]string) []string {
 }
 
 func (c *Client) Close() {
+	if c.pinger != nil {
+		c.pinger.stop()
+	}
+
 	if c.DB != nil {
 		if err := c.DB.Close(); err != nil {
-			log.Error("msg", err.Error())
+			c.logger.Error(err.Error())
 		}
 	}
 }
@@ -380,22 +682,41 @@ func (l *sampleLabels) len() int {
 	return len(l.OrderedKeys)
 }
 
-// Read implements the Reader interface and reads metrics samples from the database
-func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+// Read implements the Reader interface and reads metrics samples from
+// the database. All queries in req run inside a single read-only,
+// repeatable-read transaction so a multi-query request observes one
+// consistent snapshot instead of each query racing concurrent writers
+// independently. ctx is expected to come from the originating HTTP
+// request so a client timing out cancels the in-flight query rather
+// than tying up a connection until it finishes on its own.
+func (c *Client) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
+	begin := time.Now()
+	defer func() {
+		c.readDuration.Observe(time.Since(begin).Seconds())
+	}()
+
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		c.errorsByPhase.WithLabelValues("read_query").Inc()
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	labelsToSeries := map[string]*prompb.TimeSeries{}
 
 	for _, q := range req.Queries {
-		command, err := c.buildCommand(q)
+		command, args, err := c.buildCommand(ctx, q)
 
 		if err != nil {
 			return nil, err
 		}
 
-		log.Debug("msg", "Executed query", "query", command)
+		c.logger.Debug("Executed query", "query", command, "args", args)
 
-		rows, err := c.DB.Query(command)
+		rows, err := tx.QueryContext(ctx, command, args...)
 
 		if err != nil {
+			c.errorsByPhase.WithLabelValues("read_query").Inc()
 			return nil, err
 		}
 
@@ -411,6 +732,7 @@ func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 			err := rows.Scan(&time, &name, &value, &labels)
 
 			if err != nil {
+				c.errorsByPhase.WithLabelValues("scan").Inc()
 				return nil, err
 			}
 
@@ -447,10 +769,16 @@ func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 		err = rows.Err()
 
 		if err != nil {
+			c.errorsByPhase.WithLabelValues("read_query").Inc()
 			return nil, err
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		c.errorsByPhase.WithLabelValues("commit").Inc()
+		return nil, err
+	}
+
 	resp := prompb.ReadResponse{
 		Results: []*prompb.QueryResult{
 			{
@@ -461,26 +789,23 @@ func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 	for _, ts := range labelsToSeries {
 		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
 		if c.cfg.pgPrometheusLogSamples {
-			log.Debug("timeseries", ts.String())
+			c.logger.Debug("Timeseries", "value", ts.String())
 		}
 	}
 
-	log.Debug("msg", "Returned response", "#timeseries", len(labelsToSeries))
+	c.logger.Debug("Returned response", "#timeseries", len(labelsToSeries))
 
 	return &resp, nil
 }
 
-// HealthCheck implements the healtcheck interface
+// HealthCheck implements the healtcheck interface. It is a cheap read
+// of the last background probe's result rather than a synchronous
+// query, so it no longer competes with write traffic for a pool slot.
 func (c *Client) HealthCheck() error {
-	rows, err := c.DB.Query("SELECT 1")
-
-	if err != nil {
-		log.Debug("msg", "Health check error", "err", err)
-		return err
+	if c.pinger == nil {
+		return fmt.Errorf("background health probing is disabled")
 	}
-
-	rows.Close()
-	return nil
+	return c.pinger.check()
 }
 
 func toTimestamp(milliseconds int64) time.Time {
@@ -489,78 +814,131 @@ func toTimestamp(milliseconds int64) time.Time {
 	return time.Unix(sec, nsec).UTC()
 }
 
-func (c *Client) buildQuery(q *prompb.Query) (string, error) {
-	matchers := make([]string, 0, len(q.Matchers))
+// buildQuery renders q into a parameterized SQL statement and its
+// positional arguments ($1, $2, ...), so matcher and label values reach
+// the database as bind parameters rather than interpolated strings.
+//
+// When q has an equality matcher on __name__ plus one or more equality
+// label matchers, the query targets the normalized <table>_values/
+// <table>_labels tables joined on labels_id with a single
+// "labels @> $N::jsonb" predicate, so the GIN index on
+// <table>_labels.labels does the filtering. Anything else (pure
+// regex/negative matchers, or no equality name matcher) falls back to
+// the denormalized view, which has no such index to exploit.
+func (c *Client) buildQuery(ctx context.Context, q *prompb.Query) (string, []interface{}, error) {
+	var (
+		matchers []string
+		args     []interface{}
+	)
+
+	nextArg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	hasNameEQ := false
+	nameEQArg := ""
+	// namePredicates holds every predicate targeting __name__ other than
+	// the equality match, rendered against the literal "name" column.
+	// Once we know which table layout the query resolves to, each one is
+	// rewritten onto the right column alongside the equality predicate.
+	var namePredicates []string
 	labelEqualPredicates := make(map[string]string)
 
 	for _, m := range q.Matchers {
-		escapedName := escapeValue(m.Name)
-		escapedValue := escapeValue(m.Value)
-
 		if m.Name == model.MetricNameLabel {
 			switch m.Type {
 			case prompb.LabelMatcher_EQ:
-				if len(escapedValue) == 0 {
-					matchers = append(matchers, fmt.Sprintf("(name IS NULL OR name = '')"))
+				if len(m.Value) == 0 {
+					namePredicates = append(namePredicates, "(name IS NULL OR name = '')")
 				} else {
-					matchers = append(matchers, fmt.Sprintf("name = '%s'", escapedValue))
+					hasNameEQ = true
+					nameEQArg = nextArg(m.Value)
 				}
 			case prompb.LabelMatcher_NEQ:
-				matchers = append(matchers, fmt.Sprintf("name != '%s'", escapedValue))
+				namePredicates = append(namePredicates, fmt.Sprintf("name != %s", nextArg(m.Value)))
 			case prompb.LabelMatcher_RE:
-				matchers = append(matchers, fmt.Sprintf("name ~ '%s'", anchorValue(escapedValue)))
+				namePredicates = append(namePredicates, fmt.Sprintf("name ~ %s", nextArg(anchorValue(m.Value))))
 			case prompb.LabelMatcher_NRE:
-				matchers = append(matchers, fmt.Sprintf("name !~ '%s'", anchorValue(escapedValue)))
+				namePredicates = append(namePredicates, fmt.Sprintf("name !~ %s", nextArg(anchorValue(m.Value))))
 			default:
-				return "", fmt.Errorf("unknown metric name match type %v", m.Type)
+				return "", nil, fmt.Errorf("unknown metric name match type %v", m.Type)
 			}
-		} else {
-			switch m.Type {
-			case prompb.LabelMatcher_EQ:
-				if len(escapedValue) == 0 {
-					// From the PromQL docs: "Label matchers that match
-					// empty label values also select all time series that
-					// do not have the specific label set at all."
-					matchers = append(matchers, fmt.Sprintf("((labels ? '%s') = false OR (labels->>'%s' = ''))",
-						escapedName, escapedName))
-				} else {
-					labelEqualPredicates[escapedName] = escapedValue
-				}
-			case prompb.LabelMatcher_NEQ:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' != '%s'", escapedName, escapedValue))
-			case prompb.LabelMatcher_RE:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' ~ '%s'", escapedName, anchorValue(escapedValue)))
-			case prompb.LabelMatcher_NRE:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' !~ '%s'", escapedName, anchorValue(escapedValue)))
-			default:
-				return "", fmt.Errorf("unknown match type %v", m.Type)
+			continue
+		}
+
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			if len(m.Value) == 0 {
+				// From the PromQL docs: "Label matchers that match
+				// empty label values also select all time series that
+				// do not have the specific label set at all."
+				nameArg := nextArg(m.Name)
+				matchers = append(matchers, fmt.Sprintf("((labels ? %s) = false OR (labels->>%s = ''))", nameArg, nameArg))
+			} else {
+				labelEqualPredicates[m.Name] = m.Value
 			}
+		case prompb.LabelMatcher_NEQ:
+			matchers = append(matchers, fmt.Sprintf("labels->>%s != %s", nextArg(m.Name), nextArg(m.Value)))
+		case prompb.LabelMatcher_RE:
+			matchers = append(matchers, fmt.Sprintf("labels->>%s ~ %s", nextArg(m.Name), nextArg(anchorValue(m.Value))))
+		case prompb.LabelMatcher_NRE:
+			matchers = append(matchers, fmt.Sprintf("labels->>%s !~ %s", nextArg(m.Name), nextArg(anchorValue(m.Value))))
+		default:
+			return "", nil, fmt.Errorf("unknown match type %v", m.Type)
 		}
 	}
-	equalsPredicate := ""
 
+	var labelsJSONArg string
 	if len(labelEqualPredicates) > 0 {
 		labelsJSON, err := json.Marshal(labelEqualPredicates)
-
 		if err != nil {
-			return "", err
+			return "", nil, err
+		}
+		labelsJSONArg = nextArg(string(labelsJSON))
+	}
+
+	// Whether the query takes the normalized-join path (see doc comment
+	// above) decides which table every __name__ predicate must be
+	// checked against: the denormalized view's "name" column, or the
+	// joined labels table's "l.metric_name".
+	useNormalizedJoin := hasNameEQ && len(labelEqualPredicates) > 0
+	nameColumn := "name"
+	if useNormalizedJoin {
+		nameColumn = "l.metric_name"
+		for i, p := range namePredicates {
+			namePredicates[i] = strings.ReplaceAll(p, "name", nameColumn)
 		}
-		equalsPredicate = fmt.Sprintf(" AND labels @> '%s'", labelsJSON)
 	}
+	if hasNameEQ {
+		namePredicates = append([]string{fmt.Sprintf("%s = %s", nameColumn, nameEQArg)}, namePredicates...)
+	}
+	matchers = append(namePredicates, matchers...)
 
-	matchers = append(matchers, fmt.Sprintf("time >= '%v'", toTimestamp(q.StartTimestampMs).Format(time.RFC3339)))
-	matchers = append(matchers, fmt.Sprintf("time <= '%v'", toTimestamp(q.EndTimestampMs).Format(time.RFC3339)))
+	matchers = append(matchers, fmt.Sprintf("time >= %s", nextArg(toTimestamp(q.StartTimestampMs))))
+	matchers = append(matchers, fmt.Sprintf("time <= %s", nextArg(toTimestamp(q.EndTimestampMs))))
 
-	return fmt.Sprintf("SELECT time, name, value, labels FROM %s WHERE %s %s ORDER BY time",
-		c.cfg.table, strings.Join(matchers, " AND "), equalsPredicate), nil
-}
+	where := strings.Join(matchers, " AND ")
+
+	if useNormalizedJoin {
+		sqlString := fmt.Sprintf(
+			"SELECT v.time, l.metric_name, v.value, l.labels FROM %s_values v INNER JOIN %s_labels l ON v.labels_id = l.id WHERE %s AND l.labels @> %s::jsonb ORDER BY v.time",
+			c.cfg.table, c.cfg.table, where, labelsJSONArg)
+		return sqlString, args, nil
+	}
 
-func (c *Client) buildCommand(q *prompb.Query) (string, error) {
-	return c.buildQuery(q)
+	equalsPredicate := ""
+	if len(labelEqualPredicates) > 0 {
+		equalsPredicate = fmt.Sprintf(" AND labels @> %s::jsonb", labelsJSONArg)
+	}
+
+	sqlString := fmt.Sprintf("SELECT time, name, value, labels FROM %s WHERE %s%s ORDER BY time",
+		c.cfg.table, where, equalsPredicate)
+	return sqlString, args, nil
 }
 
-func escapeValue(str string) string {
-	return strings.Replace(str, `'`, `''`, -1)
+func (c *Client) buildCommand(ctx context.Context, q *prompb.Query) (string, []interface{}, error) {
+	return c.buildQuery(ctx, q)
 }
 
 // anchorValue adds anchors to values in regexps since PromQL docs
@@ -590,9 +968,32 @@ func (c Client) Name() string {
 
 // Describe implements prometheus.Collector.
 func (c *Client) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cacheHits.Desc()
+	ch <- c.cacheMisses.Desc()
+	ch <- c.writeDuration.Desc()
+	ch <- c.copyRows.Desc()
+	ch <- c.labelRowsInserted.Desc()
+	ch <- c.readDuration.Desc()
+	c.errorsByPhase.Describe(ch)
+	c.dbStats.Describe(ch)
+	if c.pinger != nil {
+		ch <- c.pinger.dbUp.Desc()
+		ch <- c.pinger.pingFailures.Desc()
+	}
 }
 
 // Collect implements prometheus.Collector.
 func (c *Client) Collect(ch chan<- prometheus.Metric) {
-	//ch <- c.ignoredSamples
+	ch <- c.cacheHits
+	ch <- c.cacheMisses
+	ch <- c.writeDuration
+	ch <- c.copyRows
+	ch <- c.labelRowsInserted
+	ch <- c.readDuration
+	c.errorsByPhase.Collect(ch)
+	c.dbStats.Collect(ch)
+	if c.pinger != nil {
+		ch <- c.pinger.dbUp
+		ch <- c.pinger.pingFailures
+	}
 }
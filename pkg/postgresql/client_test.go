@@ -0,0 +1,209 @@
+package pgprometheus
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func testClient() *Client {
+	return &Client{cfg: &Config{table: "metrics"}}
+}
+
+func matcher(t prompb.LabelMatcher_Type, name, value string) *prompb.LabelMatcher {
+	return &prompb.LabelMatcher{Type: t, Name: name, Value: value}
+}
+
+func TestBuildQuery_NameEQUsesDenormalizedView(t *testing.T) {
+	c := testClient()
+	q := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			matcher(prompb.LabelMatcher_EQ, model.MetricNameLabel, "up"),
+		},
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+	}
+
+	sqlString, args, err := c.buildQuery(context.Background(), q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(sqlString, "FROM metrics WHERE") {
+		t.Fatalf("expected query against the denormalized view, got: %s", sqlString)
+	}
+	if !strings.Contains(sqlString, "name = $1") {
+		t.Fatalf("expected name matcher as a bind parameter, got: %s", sqlString)
+	}
+	if len(args) != 3 || args[0] != "up" {
+		t.Fatalf("unexpected args: %#v", args)
+	}
+}
+
+func TestBuildQuery_NameEQPlusLabelEQUsesNormalizedJoin(t *testing.T) {
+	c := testClient()
+	q := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			matcher(prompb.LabelMatcher_EQ, model.MetricNameLabel, "up"),
+			matcher(prompb.LabelMatcher_EQ, "job", "node"),
+		},
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+	}
+
+	sqlString, args, err := c.buildQuery(context.Background(), q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantSQL := "SELECT v.time, l.metric_name, v.value, l.labels FROM metrics_values v INNER JOIN metrics_labels l ON v.labels_id = l.id WHERE l.metric_name = $1 AND time >= $3 AND time <= $4 AND l.labels @> $2::jsonb ORDER BY v.time"
+	if sqlString != wantSQL {
+		t.Fatalf("unexpected query:\n got: %s\nwant: %s", sqlString, wantSQL)
+	}
+
+	if len(args) != 4 || args[0] != "up" {
+		t.Fatalf("unexpected args: %#v", args)
+	}
+	labelsJSON, ok := args[1].(string)
+	if !ok || !strings.Contains(labelsJSON, "job") {
+		t.Fatalf("expected the marshaled label-equality predicate as arg 2, got: %#v", args)
+	}
+}
+
+func TestBuildQuery_MixedNameMatchersUseNormalizedJoin(t *testing.T) {
+	c := testClient()
+	q := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			matcher(prompb.LabelMatcher_EQ, model.MetricNameLabel, "up"),
+			matcher(prompb.LabelMatcher_NEQ, model.MetricNameLabel, "up_alt"),
+			matcher(prompb.LabelMatcher_EQ, "job", "node"),
+		},
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+	}
+
+	sqlString, args, err := c.buildQuery(context.Background(), q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantSQL := "SELECT v.time, l.metric_name, v.value, l.labels FROM metrics_values v INNER JOIN metrics_labels l ON v.labels_id = l.id WHERE l.metric_name = $1 AND l.metric_name != $2 AND time >= $4 AND time <= $5 AND l.labels @> $3::jsonb ORDER BY v.time"
+	if sqlString != wantSQL {
+		t.Fatalf("unexpected query:\n got: %s\nwant: %s", sqlString, wantSQL)
+	}
+	if len(args) != 5 || args[0] != "up" || args[1] != "up_alt" {
+		t.Fatalf("unexpected args: %#v", args)
+	}
+}
+
+func TestBuildQuery_NameRegexOnlyFallsBackToView(t *testing.T) {
+	c := testClient()
+	q := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			matcher(prompb.LabelMatcher_RE, model.MetricNameLabel, "up.*"),
+			matcher(prompb.LabelMatcher_EQ, "job", "node"),
+		},
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+	}
+
+	sqlString, _, err := c.buildQuery(context.Background(), q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(sqlString, "FROM metrics WHERE") {
+		t.Fatalf("expected fallback to the denormalized view without a name EQ matcher, got: %s", sqlString)
+	}
+}
+
+func TestBuildQuery_EmptyValueSemantics(t *testing.T) {
+	c := testClient()
+
+	t.Run("name", func(t *testing.T) {
+		q := &prompb.Query{Matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_EQ, model.MetricNameLabel, "")}}
+		sqlString, args, err := c.buildQuery(context.Background(), q)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(sqlString, "(name IS NULL OR name = '')") {
+			t.Fatalf("expected the NULL-or-empty name clause, got: %s", sqlString)
+		}
+		if len(args) != 2 {
+			t.Fatalf("an empty name EQ matcher should not bind a parameter, got args: %#v", args)
+		}
+	})
+
+	t.Run("label", func(t *testing.T) {
+		q := &prompb.Query{Matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_EQ, "job", "")}}
+		sqlString, args, err := c.buildQuery(context.Background(), q)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(sqlString, "(labels ? $1) = false OR (labels->>$1 = '')") {
+			t.Fatalf("expected the label not-set-or-empty clause reusing one bind parameter, got: %s", sqlString)
+		}
+		if len(args) != 3 || args[0] != "job" {
+			t.Fatalf("unexpected args: %#v", args)
+		}
+	})
+}
+
+func TestBuildQuery_NEQAndAnchoredRegex(t *testing.T) {
+	c := testClient()
+	q := &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			matcher(prompb.LabelMatcher_NEQ, "job", "node"),
+			matcher(prompb.LabelMatcher_RE, "instance", "foo.*"),
+			matcher(prompb.LabelMatcher_NRE, "env", "^prod$"),
+		},
+	}
+
+	sqlString, args, err := c.buildQuery(context.Background(), q)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(sqlString, "labels->>$1 != $2") {
+		t.Fatalf("expected a NEQ predicate, got: %s", sqlString)
+	}
+	if !strings.Contains(sqlString, "labels->>$3 ~ $4") {
+		t.Fatalf("expected a RE predicate, got: %s", sqlString)
+	}
+	if !strings.Contains(sqlString, "labels->>$5 !~ $6") {
+		t.Fatalf("expected a NRE predicate, got: %s", sqlString)
+	}
+
+	var anchoredRE, anchoredNRE string
+	for i, a := range args {
+		if a == "instance" {
+			anchoredRE = args[i+1].(string)
+		}
+		if a == "env" {
+			anchoredNRE = args[i+1].(string)
+		}
+	}
+	if anchoredRE != "^foo.*$" {
+		t.Fatalf("expected an unanchored regex to be anchored on both sides, got %q", anchoredRE)
+	}
+	if anchoredNRE != "^prod$" {
+		t.Fatalf("expected an already-anchored regex to be left alone, got %q", anchoredNRE)
+	}
+}
+
+func TestBuildQuery_UnknownMatchType(t *testing.T) {
+	c := testClient()
+
+	q := &prompb.Query{Matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_Type(99), "job", "node")}}
+	if _, _, err := c.buildQuery(context.Background(), q); err == nil {
+		t.Fatalf("expected an error for an unknown label match type")
+	}
+
+	q = &prompb.Query{Matchers: []*prompb.LabelMatcher{matcher(prompb.LabelMatcher_Type(99), model.MetricNameLabel, "up")}}
+	if _, _, err := c.buildQuery(context.Background(), q); err == nil {
+		t.Fatalf("expected an error for an unknown metric name match type")
+	}
+}
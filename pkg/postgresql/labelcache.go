@@ -0,0 +1,75 @@
+package pgprometheus
+
+import (
+	"container/list"
+	"sync"
+)
+
+// labelCache is a bounded, in-process LRU that maps a metric's label
+// fingerprint (see labelFingerprint) to the labels_id row already
+// present in <table>_labels. Write consults it to skip the
+// INSERT-labels round trip for series it has already seen. With a
+// capacity of 0 or less the cache itself never evicts; Write only uses
+// it when the configured size is positive.
+type labelCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type labelCacheEntry struct {
+	key string
+	id  int64
+}
+
+func newLabelCache(capacity int) *labelCache {
+	return &labelCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached labels_id for key, if any, and marks it
+// most-recently-used.
+func (c *labelCache) Get(key string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return 0, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*labelCacheEntry).id, true
+}
+
+// Add records that key maps to id, evicting the least-recently-used
+// entry if the cache is at capacity.
+func (c *labelCache) Add(key string, id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*labelCacheEntry).id = id
+		return
+	}
+
+	el := c.ll.PushFront(&labelCacheEntry{key: key, id: id})
+	c.items[key] = el
+
+	if c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*labelCacheEntry).key)
+	}
+}
+
+// Len returns the number of entries currently cached.
+func (c *labelCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
@@ -0,0 +1,89 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLabelCache_GetMiss(t *testing.T) {
+	c := newLabelCache(10)
+
+	if _, ok := c.Get("missing"); ok {
+		t.Fatalf("expected a miss on an empty cache")
+	}
+}
+
+func TestLabelCache_AddAndGet(t *testing.T) {
+	c := newLabelCache(10)
+
+	c.Add("up", 1)
+	if id, ok := c.Get("up"); !ok || id != 1 {
+		t.Fatalf("expected (1, true), got (%d, %v)", id, ok)
+	}
+	if got := c.Len(); got != 1 {
+		t.Fatalf("expected Len() == 1, got %d", got)
+	}
+}
+
+func TestLabelCache_AddOverwritesExistingKey(t *testing.T) {
+	c := newLabelCache(10)
+
+	c.Add("up", 1)
+	c.Add("up", 2)
+
+	if id, ok := c.Get("up"); !ok || id != 2 {
+		t.Fatalf("expected the id to be updated to 2, got (%d, %v)", id, ok)
+	}
+	if got := c.Len(); got != 1 {
+		t.Fatalf("expected a single entry after re-adding the same key, got %d", got)
+	}
+}
+
+func TestLabelCache_EvictsLeastRecentlyUsedAtCapacity(t *testing.T) {
+	c := newLabelCache(2)
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3) // over capacity: "a" is least-recently-used, evicted
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("expected \"a\" to have been evicted")
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Fatalf("expected \"b\" to still be cached")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Fatalf("expected \"c\" to still be cached")
+	}
+	if got := c.Len(); got != 2 {
+		t.Fatalf("expected Len() == 2, got %d", got)
+	}
+}
+
+func TestLabelCache_GetRefreshesRecency(t *testing.T) {
+	c := newLabelCache(2)
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")    // "a" is now most-recently-used
+	c.Add("c", 3) // over capacity: "b" is now least-recently-used, evicted
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("expected \"b\" to have been evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("expected \"a\" to still be cached after Get refreshed its recency")
+	}
+}
+
+func TestLabelCache_ZeroCapacityNeverEvicts(t *testing.T) {
+	c := newLabelCache(0)
+
+	for i := 0; i < 1000; i++ {
+		c.Add(fmt.Sprintf("key-%d", i), int64(i))
+	}
+
+	if got := c.Len(); got != 1000 {
+		t.Fatalf("expected a capacity-0 cache to keep every entry, got Len() == %d", got)
+	}
+}
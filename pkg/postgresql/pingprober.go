@@ -0,0 +1,145 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// staleAfterIntervals bounds how many consecutive probe intervals
+// HealthCheck tolerates without a successful probe before treating the
+// last known-good state as stale, even absent an explicit probe error
+// (e.g. the cron goroutine wedged).
+const staleAfterIntervals = 3
+
+// pingProber runs a cheap DB.PingContext on a cron schedule in the
+// background so HealthCheck becomes a non-blocking read of the last
+// result instead of a synchronous "SELECT 1" that competes with write
+// traffic for a pool slot on every HTTP health-check request.
+type pingProber struct {
+	db       *sql.DB
+	timeout  time.Duration
+	interval time.Duration
+	cron     *cron.Cron
+	logger   log.Logger
+
+	dbUp         prometheus.Gauge
+	pingFailures prometheus.Counter
+
+	mu                  sync.Mutex
+	lastSuccess         time.Time
+	consecutiveFailures int
+	lastErr             error
+}
+
+// newPingProber parses spec (a cron expression, e.g. "@every 30s") and
+// builds a pingProber ready to be started with start(). It does not
+// start probing; call start() once the Client is otherwise ready.
+func newPingProber(db *sql.DB, spec string, timeout time.Duration, logger log.Logger) (*pingProber, error) {
+	parser := cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+	schedule, err := parser.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pg-ping-cron spec %q: %w", spec, err)
+	}
+
+	// Derive the staleness interval from two consecutive scheduled firings
+	// rather than schedule.Next(now).Sub(now): for a fixed-period spec like
+	// "@every 30s" the two are equivalent, but for a cron expression like
+	// "0 */5 * * * *" the latter is just however much of the current period
+	// happens to be left at startup, which can be seconds instead of
+	// minutes and would make check() report staleness spuriously soon.
+	first := schedule.Next(time.Now())
+	interval := schedule.Next(first).Sub(first)
+
+	p := &pingProber{
+		db:       db,
+		timeout:  timeout,
+		interval: interval,
+		cron:     cron.New(cron.WithParser(parser)),
+		logger:   logger,
+		dbUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "adapter",
+			Name:      "db_up",
+			Help:      "Whether the last background DB health probe succeeded (1) or failed (0).",
+		}),
+		pingFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "adapter",
+			Name:      "db_ping_failures_total",
+			Help:      "Total number of failed background DB health probes.",
+		}),
+	}
+
+	if _, err := p.cron.AddJob(spec, cron.FuncJob(p.probe)); err != nil {
+		return nil, fmt.Errorf("invalid pg-ping-cron spec %q: %w", spec, err)
+	}
+
+	return p, nil
+}
+
+// start runs an initial probe synchronously, so HealthCheck has a
+// result immediately rather than waiting up to one interval, then
+// starts the background schedule.
+func (p *pingProber) start() {
+	p.probe()
+	p.cron.Start()
+}
+
+// stop halts the background schedule. It does not wait for an
+// in-flight probe; callers that need that should use p.cron.Stop()'s
+// returned context directly if this is ever needed.
+func (p *pingProber) stop() {
+	p.cron.Stop()
+}
+
+func (p *pingProber) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	err := p.db.PingContext(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		p.consecutiveFailures++
+		p.lastErr = err
+		p.dbUp.Set(0)
+		p.pingFailures.Inc()
+		p.logger.Error("Background DB health probe failed", "consecutive_failures", p.consecutiveFailures, "err", err)
+		return
+	}
+
+	p.consecutiveFailures = 0
+	p.lastErr = nil
+	p.lastSuccess = time.Now()
+	p.dbUp.Set(1)
+}
+
+// check returns a cheap, non-blocking view of DB health based on the
+// most recent background probe.
+func (p *pingProber) check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lastErr != nil {
+		return fmt.Errorf("last background health probe failed: %w", p.lastErr)
+	}
+
+	if p.lastSuccess.IsZero() {
+		return fmt.Errorf("no successful background health probe yet")
+	}
+
+	if age := time.Since(p.lastSuccess); age > p.interval*staleAfterIntervals {
+		return fmt.Errorf("last successful background health probe was %s ago, exceeding staleness threshold", age)
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package pgprometheus
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPingProber_CheckBeforeFirstProbe(t *testing.T) {
+	p := &pingProber{interval: time.Second}
+
+	if err := p.check(); err == nil {
+		t.Fatalf("expected an error before any probe has succeeded")
+	}
+}
+
+func TestPingProber_CheckReturnsLastError(t *testing.T) {
+	p := &pingProber{interval: time.Second, lastErr: errors.New("ping failed")}
+
+	err := p.check()
+	if err == nil {
+		t.Fatalf("expected an error carrying the last probe failure")
+	}
+}
+
+func TestPingProber_CheckOKWhenRecent(t *testing.T) {
+	p := &pingProber{interval: time.Minute, lastSuccess: time.Now()}
+
+	if err := p.check(); err != nil {
+		t.Fatalf("expected no error for a recent successful probe, got: %v", err)
+	}
+}
+
+func TestPingProber_CheckStaleAfterThreshold(t *testing.T) {
+	p := &pingProber{
+		interval:    time.Second,
+		lastSuccess: time.Now().Add(-time.Second * (staleAfterIntervals + 1)),
+	}
+
+	if err := p.check(); err == nil {
+		t.Fatalf("expected a staleness error once the last success exceeds interval*staleAfterIntervals")
+	}
+}